@@ -16,6 +16,7 @@ package payload
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"io"
 	"testing"
@@ -81,6 +82,340 @@ func (s *PayloadSuite) TestWriteReadMetaPayload(c *C) {
 	c.Assert(payload1, comparator.DeepEquals, payload2)
 }
 
+func (s *PayloadSuite) TestReadMetaPayloadLimit_OversizedFrameRejected(c *C) {
+	meta1 := Meta{Size: 1234}
+	payload1 := Payload{
+		Data: []byte{1, 2, 3, 4},
+		Lost: 5243,
+		CPU:  12,
+		Type: 9,
+	}
+
+	var buf bytes.Buffer
+	err := WriteMetaPayload(&buf, &meta1, &payload1)
+	c.Assert(err, Equals, nil)
+
+	var meta2 Meta
+	var payload2 Payload
+	err = ReadMetaPayloadLimit(&buf, uint64(meta1.Size)-1, &meta2, &payload2)
+	c.Assert(err, FitsTypeOf, &ErrPayloadTooLarge{})
+
+	// The oversized frame must have been drained so the stream is
+	// resyncable: nothing should be left to read.
+	c.Assert(buf.Len(), Equals, 0)
+}
+
+func (s *PayloadSuite) TestReadMetaPayloadLimit_ResyncsAfterOversizedFrame(c *C) {
+	small := Payload{Data: []byte{9, 9, 9}, Lost: 1, CPU: 0, Type: 1}
+	big := Payload{Data: bytes.Repeat([]byte{0xAB}, 64), Lost: 2, CPU: 1, Type: 2}
+
+	var buf bytes.Buffer
+	var bigMeta Meta
+	err := WriteMetaPayload(&buf, &bigMeta, &big)
+	c.Assert(err, Equals, nil)
+
+	var smallMeta Meta
+	err = WriteMetaPayload(&buf, &smallMeta, &small)
+	c.Assert(err, Equals, nil)
+
+	var meta Meta
+	var pl Payload
+	err = ReadMetaPayloadLimit(&buf, uint64(bigMeta.Size)-1, &meta, &pl)
+	c.Assert(err, FitsTypeOf, &ErrPayloadTooLarge{})
+
+	// The next frame in the stream must still decode cleanly.
+	err = ReadMetaPayloadLimit(&buf, 0, &meta, &pl)
+	c.Assert(err, Equals, nil)
+	c.Assert(pl, comparator.DeepEquals, small)
+}
+
+func (s *PayloadSuite) TestReadMetaPayloadLimit_NonByteReaderStream(c *C) {
+	// io.MultiReader never implements io.ByteReader, even when everything
+	// it wraps does; this stands in for a raw net.Conn, which doesn't
+	// implement it either. Decoding Meta through gob over such a reader
+	// must not read ahead into the next frame.
+	first := Payload{Data: []byte{1, 2, 3, 4}, Lost: 1, CPU: 0, Type: 1}
+	second := Payload{Data: []byte{5, 6, 7, 8, 9}, Lost: 2, CPU: 1, Type: 2}
+
+	var buf bytes.Buffer
+	var meta1, meta2 Meta
+	err := WriteMetaPayload(&buf, &meta1, &first)
+	c.Assert(err, Equals, nil)
+	err = WriteMetaPayload(&buf, &meta2, &second)
+	c.Assert(err, Equals, nil)
+
+	stream := io.MultiReader(&buf)
+
+	var outMeta, outMeta2 Meta
+	var out, out2 Payload
+	err = ReadMetaPayloadLimit(stream, 0, &outMeta, &out)
+	c.Assert(err, Equals, nil)
+	c.Assert(out, comparator.DeepEquals, first)
+
+	err = ReadMetaPayloadLimit(stream, 0, &outMeta2, &out2)
+	c.Assert(err, Equals, nil)
+	c.Assert(out2, comparator.DeepEquals, second)
+}
+
+func (s *PayloadSuite) TestReadMetaPayloadLimit_ShortRead(c *C) {
+	meta1 := Meta{Size: 1234}
+	payload1 := Payload{
+		Data: []byte{1, 2, 3, 4},
+		Lost: 5243,
+		CPU:  12,
+		Type: 9,
+	}
+
+	var buf bytes.Buffer
+	err := WriteMetaPayload(&buf, &meta1, &payload1)
+	c.Assert(err, Equals, nil)
+
+	// Truncate the body to simulate a peer that hung up mid-frame.
+	truncated := bytes.NewReader(buf.Bytes()[:buf.Len()-1])
+
+	var meta2 Meta
+	var payload2 Payload
+	err = ReadMetaPayloadLimit(truncated, 0, &meta2, &payload2)
+	c.Assert(err, Not(Equals), nil)
+}
+
+func BenchmarkReadMetaPayloadLimit_WithinLimit(b *testing.B) {
+	meta1 := Meta{Size: 1234}
+	payload1 := Payload{
+		Data: []byte{1, 2, 3, 4},
+		Lost: 5243,
+		CPU:  12,
+		Type: 9,
+	}
+
+	var buf bytes.Buffer
+	err := WriteMetaPayload(&buf, &meta1, &payload1)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var meta2 Meta
+	var payload2 Payload
+	for i := 0; i < b.N; i++ {
+		readBuf := bytes.NewBuffer(buf.Bytes())
+		err = ReadMetaPayloadLimit(readBuf, 4096, &meta2, &payload2)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func (s *PayloadSuite) TestBinaryCodec_Decode_RejectsDataLenBeyondBudget(c *C) {
+	// A frame whose data-len claims to need far more bytes than the
+	// caller's max (less the header already read) must be rejected before
+	// allocating, not after a multi-gigabyte make() already ran.
+	var body bytes.Buffer
+	err := BinaryCodec.Encode(&body, &Payload{Data: []byte{1, 2, 3, 4}})
+	c.Assert(err, Equals, nil)
+
+	raw := body.Bytes()
+	binary.LittleEndian.PutUint32(raw[12:16], 0xFFFFFFFF)
+
+	meta := Meta{Size: uint32(len(raw))}
+	metadata, err := meta.MarshalBinary()
+	c.Assert(err, Equals, nil)
+
+	var frame bytes.Buffer
+	frame.Write(streamMagic[:])
+	frame.WriteByte(codecIDs[BinaryCodec.Name()])
+	frame.Write(metadata)
+	frame.Write(raw)
+
+	var outMeta Meta
+	var outPl Payload
+	err = ReadMetaPayloadLimit(&frame, uint64(meta.Size), &outMeta, &outPl)
+	c.Assert(err, Not(Equals), nil)
+}
+
+func BenchmarkReadMetaPayloadLimit_OversizedFrame(b *testing.B) {
+	meta1 := Meta{Size: 1234}
+	payload1 := Payload{
+		Data: []byte{1, 2, 3, 4},
+		Lost: 5243,
+		CPU:  12,
+		Type: 9,
+	}
+
+	var buf bytes.Buffer
+	err := WriteMetaPayload(&buf, &meta1, &payload1)
+	if err != nil {
+		b.Fatal(err)
+	}
+	frame := buf.Bytes()
+
+	var meta2 Meta
+	var payload2 Payload
+	for i := 0; i < b.N; i++ {
+		readBuf := bytes.NewBuffer(frame)
+		if err := ReadMetaPayloadLimit(readBuf, uint64(meta1.Size)-1, &meta2, &payload2); err == nil {
+			b.Fatal("expected ErrPayloadTooLarge")
+		}
+	}
+}
+
+func (s *PayloadSuite) TestBinaryCodec_RoundTrip(c *C) {
+	payload1 := Payload{
+		Data: []byte{1, 2, 3, 4},
+		Lost: 5243,
+		CPU:  12,
+		Type: 9,
+	}
+
+	var buf bytes.Buffer
+	err := BinaryCodec.Encode(&buf, &payload1)
+	c.Assert(err, Equals, nil)
+
+	var payload2 Payload
+	err = BinaryCodec.Decode(&buf, &payload2)
+	c.Assert(err, Equals, nil)
+	c.Assert(payload1, comparator.DeepEquals, payload2)
+}
+
+func (s *PayloadSuite) TestWriteReadMetaPayload_BinaryCodec(c *C) {
+	old := DefaultCodec
+	DefaultCodec = BinaryCodec
+	defer func() { DefaultCodec = old }()
+
+	meta1 := Meta{Size: 1234}
+	payload1 := Payload{
+		Data: []byte{1, 2, 3, 4},
+		Lost: 5243,
+		CPU:  12,
+		Type: 9,
+	}
+
+	var buf bytes.Buffer
+	err := WriteMetaPayload(&buf, &meta1, &payload1)
+	c.Assert(err, Equals, nil)
+
+	var meta2 Meta
+	var payload2 Payload
+	err = ReadMetaPayload(&buf, &meta2, &payload2)
+	c.Assert(err, Equals, nil)
+
+	c.Assert(meta1, comparator.DeepEquals, meta2)
+	c.Assert(payload1, comparator.DeepEquals, payload2)
+}
+
+func (s *PayloadSuite) TestReadMetaPayload_LegacyStreamWithoutCodecHeader(c *C) {
+	meta1 := Meta{Size: 1234}
+	payload1 := Payload{
+		Data: []byte{1, 2, 3, 4},
+		Lost: 5243,
+		CPU:  12,
+		Type: 9,
+	}
+
+	var body bytes.Buffer
+	err := gob.NewEncoder(&body).Encode(&payload1)
+	c.Assert(err, Equals, nil)
+	meta1.Size = uint32(body.Len())
+	metadata, err := meta1.MarshalBinary()
+	c.Assert(err, Equals, nil)
+
+	var buf bytes.Buffer
+	buf.Write(metadata)
+	body.WriteTo(&buf)
+
+	var meta2 Meta
+	var payload2 Payload
+	err = ReadMetaPayload(&buf, &meta2, &payload2)
+	c.Assert(err, Equals, nil)
+
+	c.Assert(meta1, comparator.DeepEquals, meta2)
+	c.Assert(payload1, comparator.DeepEquals, payload2)
+}
+
+func (s *PayloadSuite) TestMeta_OldReaderCompatibility_CompressionOff(c *C) {
+	// A decoder built before Compression/UncompressedSize existed only
+	// knows about Size. As long as Compression stays CompressionNone (the
+	// default), it must still be able to decode Size out of a Meta gob
+	// stream produced by this version of the package.
+	type oldMeta struct {
+		Size uint32
+	}
+
+	meta1 := Meta{Size: 4321}
+	buf, err := meta1.MarshalBinary()
+	c.Assert(err, Equals, nil)
+
+	var old oldMeta
+	err = gob.NewDecoder(bytes.NewReader(buf)).Decode(&old)
+	c.Assert(err, Equals, nil)
+	c.Assert(old.Size, Equals, meta1.Size)
+}
+
+func (s *PayloadSuite) TestWriteReadMetaPayload_Compressed(c *C) {
+	old := DefaultCompression
+	DefaultCompression = CompressionGzip
+	defer func() { DefaultCompression = old }()
+
+	meta1 := Meta{}
+	payload1 := Payload{
+		Data: bytes.Repeat([]byte("cilium monitor payload"), 64),
+		Lost: 5243,
+		CPU:  12,
+		Type: 9,
+	}
+
+	var buf bytes.Buffer
+	err := WriteMetaPayload(&buf, &meta1, &payload1)
+	c.Assert(err, Equals, nil)
+	c.Assert(meta1.Compression, Equals, CompressionGzip)
+
+	var meta2 Meta
+	var payload2 Payload
+	err = ReadMetaPayload(&buf, &meta2, &payload2)
+	c.Assert(err, Equals, nil)
+
+	c.Assert(payload1, comparator.DeepEquals, payload2)
+}
+
+func (s *PayloadSuite) TestGzipCompressor_Decompress_RejectsBomb(c *C) {
+	old := MaxDecompressedSize
+	MaxDecompressedSize = 1024
+	defer func() { MaxDecompressedSize = old }()
+
+	compressed, err := gzipCompressor{}.Compress(bytes.Repeat([]byte{0}, 10*1024))
+	c.Assert(err, Equals, nil)
+
+	// sizeHint is attacker-controlled on the wire; a tiny compressed
+	// input claiming a huge UncompressedSize must not be trusted for
+	// either the preallocation or the output size.
+	_, err = gzipCompressor{}.Decompress(compressed, 1<<30)
+	c.Assert(err, Not(Equals), nil)
+}
+
+func (s *PayloadSuite) TestGzipCompressor_RoundTripWithinLimit(c *C) {
+	data := bytes.Repeat([]byte("cilium monitor payload"), 64)
+	compressed, err := gzipCompressor{}.Compress(data)
+	c.Assert(err, Equals, nil)
+
+	out, err := gzipCompressor{}.Decompress(compressed, len(data))
+	c.Assert(err, Equals, nil)
+	c.Assert(out, comparator.DeepEquals, data)
+}
+
+func (s *PayloadSuite) TestWriteMetaPayload_SkipsCompressionBelowMinSize(c *C) {
+	old := DefaultCompression
+	DefaultCompression = CompressionGzip
+	defer func() { DefaultCompression = old }()
+
+	meta1 := Meta{}
+	payload1 := Payload{Data: []byte{1, 2, 3, 4}}
+	c.Assert(len(payload1.Data) < MinCompressSize, Equals, true)
+
+	var buf bytes.Buffer
+	err := WriteMetaPayload(&buf, &meta1, &payload1)
+	c.Assert(err, Equals, nil)
+	c.Assert(meta1.Compression, Equals, CompressionNone)
+}
+
 func BenchmarkWriteMetaPayload(b *testing.B) {
 	meta := Meta{Size: 1234}
 	pl := Payload{
@@ -169,6 +504,45 @@ func BenchmarkDecodeMetaPayload(b *testing.B) {
 	}
 }
 
+func BenchmarkPayloadBinaryEncode(b *testing.B) {
+	pl := Payload{
+		Data: []byte{1, 2, 3, 4},
+		Lost: 5243,
+		CPU:  12,
+		Type: 9,
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := BinaryCodec.Encode(&buf, &pl); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPayloadBinaryDecode(b *testing.B) {
+	pl := Payload{
+		Data: []byte{1, 2, 3, 4},
+		Lost: 5243,
+		CPU:  12,
+		Type: 9,
+	}
+
+	var encoded bytes.Buffer
+	if err := BinaryCodec.Encode(&encoded, &pl); err != nil {
+		b.Fatal(err)
+	}
+
+	var pl2 Payload
+	for i := 0; i < b.N; i++ {
+		reader := bytes.NewReader(encoded.Bytes())
+		if err := BinaryCodec.Decode(reader, &pl2); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkMetaGobEncode(b *testing.B) {
 	meta := Meta{Size: 1234}
 